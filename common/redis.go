@@ -1,14 +1,189 @@
 package common
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"msgpack"
+	"prometheus"
 	"redigo/redis"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var pool *redis.Pool
 
+// Codec controls how values are serialized to and from the Redis byte
+// strings used by RedisSaveWithConn/RedisLoadWithConn and RedisSlice.
+// The default, until SetCodec is called, is GobCodec, which delegates to the
+// existing GobEncode/GobDecode and preserves today's on-disk format.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+var codec Codec = GobCodec
+
+// SetCodec changes the Codec used by subsequent Redis reads and writes.
+// It does not affect data already written under a different codec, so
+// switching codecs on a live deployment requires a migration.
+func SetCodec(c Codec) {
+	codec = c
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(v interface{}) ([]byte, error) { return GobEncode(v) }
+
+func (gobCodec) Decode(data []byte, v interface{}) error { return GobDecode(data, v) }
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Decode(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgpackCodec) Decode(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// Built-in Codec implementations. GobCodec is the default and matches
+// the format irctalk-server has always stored; JSONCodec and
+// MsgpackCodec are for operators who want to inspect values with
+// redis-cli or share them with non-Go tooling.
+var (
+	GobCodec     Codec = gobCodec{}
+	JSONCodec    Codec = jsonCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+)
+
+// Logger receives diagnostics from the Redis wrappers, in particular the
+// command errors that used to be swallowed (e.g. a failed RedisNumber
+// GET silently returning 0). The default is a no-op.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Printf(format string, args ...interface{}) {}
+
+var logger Logger = noopLogger{}
+
+// SetLogger changes the Logger used by the Redis wrappers.
+func SetLogger(l Logger) {
+	logger = l
+}
+
+// Metrics receives a callback for every Redis command the wrappers issue,
+// so operators can see Redis pressure from IRC session load without
+// reading logs. The default is a no-op; see NewPrometheusMetrics for a
+// ready-made adapter.
+type Metrics interface {
+	OnCommand(cmd string, args []interface{}, dur time.Duration, err error)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) OnCommand(cmd string, args []interface{}, dur time.Duration, err error) {}
+
+var metrics Metrics = noopMetrics{}
+
+// SetMetrics changes the Metrics used by the Redis wrappers.
+func SetMetrics(m Metrics) {
+	metrics = m
+}
+
+// PrometheusMetrics is a Metrics adapter that records command counts,
+// error counts, and latency as Prometheus counters/histograms labeled by
+// command name.
+type PrometheusMetrics struct {
+	commands *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+// NewPrometheusMetrics creates and registers a PrometheusMetrics with the
+// default registry. Pass the result to SetMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "irctalk_redis_commands_total",
+			Help: "Total number of Redis commands issued by the common Redis wrappers.",
+		}, []string{"cmd"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "irctalk_redis_command_errors_total",
+			Help: "Total number of Redis commands that returned an error.",
+		}, []string{"cmd"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "irctalk_redis_command_duration_seconds",
+			Help: "Redis command latency as observed by the common Redis wrappers.",
+		}, []string{"cmd"}),
+	}
+	prometheus.MustRegister(m.commands, m.errors, m.latency)
+	return m
+}
+
+func (m *PrometheusMetrics) OnCommand(cmd string, args []interface{}, dur time.Duration, err error) {
+	m.commands.WithLabelValues(cmd).Inc()
+	m.latency.WithLabelValues(cmd).Observe(dur.Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(cmd).Inc()
+	}
+}
+
+// doCmd runs cmd on r, timing it and reporting the result through the
+// package's Logger/Metrics hooks. It is the synchronous counterpart of
+// doContext, used by call sites that don't carry a context.Context.
+func doCmd(r redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := r.Do(cmd, args...)
+	metrics.OnCommand(cmd, args, time.Since(start), err)
+	if err != nil {
+		logger.Printf("common: %s %v: %v", cmd, args, err)
+	}
+	return reply, err
+}
+
+// RedisMode selects how MakeRedisPool reaches the Redis deployment.
+type RedisMode int
+
+const (
+	// RedisModeSingle dials config.Addr directly. This is the default
+	// when Mode is left zero, so existing configs keep working unmodified.
+	RedisModeSingle RedisMode = iota
+	// RedisModeSentinel asks one of config.SentinelAddrs for the current
+	// master of config.MasterName before every Dial.
+	RedisModeSentinel
+	// RedisModeCluster dials one of config.ClusterAddrs and follows
+	// MOVED/ASK redirections to route to the right node.
+	RedisModeCluster
+)
+
+// RedisConfig describes how to reach the Redis deployment backing
+// MakeRedisPool. Mode defaults to RedisModeSingle, so existing configs
+// that only set Addr/Password/Database/MaxIdle keep working unmodified.
+type RedisConfig struct {
+	Addr     string
+	Password string
+	Database int
+	MaxIdle  int
+
+	Mode RedisMode
+
+	// SentinelAddrs and MasterName are used when Mode is RedisModeSentinel.
+	SentinelAddrs []string
+	MasterName    string
+
+	// ClusterAddrs is the cluster seed list used when Mode is RedisModeCluster.
+	ClusterAddrs []string
+}
+
 func DefaultRedisPool() *redis.Pool {
 	return pool
 }
@@ -18,24 +193,226 @@ func MakeRedisPool(config RedisConfig) {
 		pool.Close()
 	}
 	pool = redis.NewPool(func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", config.Addr)
+		addr, err := config.dialAddr()
 		if err != nil {
 			return nil, err
 		}
-		if config.Password != "" {
-			_, err = c.Do("AUTH", config.Password)
-			if err != nil {
-				return nil, err
-			}
-		}
-		_, err = c.Do("SELECT", config.Database)
+		c, err := config.dialAuthed(addr)
 		if err != nil {
 			return nil, err
 		}
-		return c, nil
+		return newFailoverConn(c, config), nil
 	}, config.MaxIdle)
 }
 
+// dialAuthed dials addr and brings the connection up to the state every
+// caller expects before using it: AUTHed with config.Password (if set) and
+// SELECTed onto config.Database. Both MakeRedisPool's pool factory and
+// failoverConn's post-redirect redial must go through this, or a
+// redirected connection silently ends up unauthenticated or on the wrong
+// database instead of just dropped.
+func (config RedisConfig) dialAuthed(addr string) (redis.Conn, error) {
+	c, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.Password != "" {
+		if _, err := c.Do("AUTH", config.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if _, err := c.Do("SELECT", config.Database); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialAddr resolves the address that should be dialed for this config,
+// probing Sentinel for the current master when in RedisModeSentinel.
+func (config RedisConfig) dialAddr() (string, error) {
+	switch config.Mode {
+	case RedisModeSentinel:
+		return config.queryMaster()
+	case RedisModeCluster:
+		return config.queryCluster()
+	default:
+		return config.Addr, nil
+	}
+}
+
+// queryMaster asks each sentinel in turn for the master currently assigned
+// to MasterName, returning the first one that answers.
+func (config RedisConfig) queryMaster() (string, error) {
+	if config.MasterName == "" {
+		return "", errors.New("common: RedisConfig.MasterName is required in sentinel mode")
+	}
+	var lastErr error
+	for _, sentinelAddr := range config.SentinelAddrs {
+		addr, err := queryMasterFromSentinel(sentinelAddr, config.MasterName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return addr, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("common: no sentinel addresses configured")
+	}
+	return "", fmt.Errorf("common: unable to find master %q: %v", config.MasterName, lastErr)
+}
+
+// queryCluster tries each seed in ClusterAddrs in turn, the same way
+// queryMaster tries each sentinel, and returns the first one that accepts a
+// connection. Without this, a dead first seed would block pool growth even
+// though the rest of the seed list is reachable; redirects seen on
+// already-open connections are still handled separately by failoverConn.
+func (config RedisConfig) queryCluster() (string, error) {
+	if len(config.ClusterAddrs) == 0 {
+		return "", errors.New("common: RedisConfig.ClusterAddrs is empty")
+	}
+	var lastErr error
+	for _, addr := range config.ClusterAddrs {
+		c, err := redis.DialTimeout("tcp", addr, time.Second, time.Second, time.Second)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.Close()
+		return addr, nil
+	}
+	return "", fmt.Errorf("common: no reachable cluster seed in %v: %v", config.ClusterAddrs, lastErr)
+}
+
+func queryMasterFromSentinel(sentinelAddr, masterName string) (string, error) {
+	c, err := redis.DialTimeout("tcp", sentinelAddr, time.Second, time.Second, time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", masterName))
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("common: unexpected SENTINEL reply %v", reply)
+	}
+	return reply[0] + ":" + reply[1], nil
+}
+
+// failoverConn wraps every pooled redis.Conn, regardless of RedisMode,
+// and retries a command once when it sees a redirect or failover error:
+// MOVED/ASK redial to the node the cluster names (ASK additionally sends
+// ASKING before replaying the command, as a real ASK redirect requires),
+// and READONLY re-resolves the dial address via config.dialAddr() (which
+// re-queries Sentinel for the new master in RedisModeSentinel) and
+// redials that instead. The redial goes through config.dialAuthed, the
+// same AUTH/SELECT sequence MakeRedisPool's pool factory uses, so a
+// redirected connection doesn't silently end up unauthenticated or on
+// the wrong database.
+type failoverConn struct {
+	redis.Conn
+	config RedisConfig
+}
+
+func newFailoverConn(c redis.Conn, config RedisConfig) redis.Conn {
+	return &failoverConn{Conn: c, config: config}
+}
+
+func (fc *failoverConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := fc.Conn.Do(cmd, args...)
+	if err == nil {
+		return reply, nil
+	}
+
+	redirect, ok := parseRedirect(err)
+	if !ok {
+		return reply, err
+	}
+
+	addr := redirect.addr
+	if redirect.kind == "READONLY" {
+		var addrErr error
+		addr, addrErr = fc.config.dialAddr()
+		if addrErr != nil {
+			return reply, err
+		}
+	}
+
+	next, dialErr := fc.config.dialAuthed(addr)
+	if dialErr != nil {
+		return reply, err
+	}
+	if redirect.kind == "ASK" {
+		if _, askErr := next.Do("ASKING"); askErr != nil {
+			next.Close()
+			return reply, err
+		}
+	}
+
+	fc.Conn.Close()
+	fc.Conn = next
+	return fc.Conn.Do(cmd, args...)
+}
+
+// DoWithTimeout and ReceiveWithTimeout make failoverConn a
+// redis.ConnWithTimeout, so redis.DoWithTimeout on a pooled connection
+// (as doContext uses) reaches the wrapped connection. A redirect or
+// failover error is handled by replaying the command through Do, without
+// the timeout.
+func (fc *failoverConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := redis.DoWithTimeout(fc.Conn, timeout, cmd, args...)
+	if _, ok := parseRedirect(err); !ok {
+		return reply, err
+	}
+	return fc.Do(cmd, args...)
+}
+
+func (fc *failoverConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(fc.Conn, timeout)
+}
+
+// redisRedirect is a parsed MOVED/ASK/READONLY error from a Redis server.
+type redisRedirect struct {
+	kind string // "MOVED", "ASK", or "READONLY"
+	addr string // "host:port" target; empty for READONLY
+}
+
+// parseRedirect recognizes the three redis.Error forms that mean "retry
+// this command elsewhere": "MOVED slot host:port", "ASK slot host:port",
+// and the argument-less "READONLY ...". It reports ok=false for any
+// other error, which callers should just return as-is.
+func parseRedirect(err error) (redisRedirect, bool) {
+	re, isRedisErr := err.(redis.Error)
+	if !isRedisErr {
+		return redisRedirect{}, false
+	}
+	msg := string(re)
+	switch {
+	case strings.HasPrefix(msg, "MOVED "):
+		addr, ok := parseRedirectAddr(msg)
+		return redisRedirect{kind: "MOVED", addr: addr}, ok
+	case strings.HasPrefix(msg, "ASK "):
+		addr, ok := parseRedirectAddr(msg)
+		return redisRedirect{kind: "ASK", addr: addr}, ok
+	case strings.HasPrefix(msg, "READONLY"):
+		return redisRedirect{kind: "READONLY"}, true
+	default:
+		return redisRedirect{}, false
+	}
+}
+
+func parseRedirectAddr(msg string) (addr string, ok bool) {
+	var kind, addrPart string
+	n, scanErr := fmt.Sscanf(msg, "%s %d %s", &kind, new(int), &addrPart)
+	if scanErr != nil || n != 3 {
+		return "", false
+	}
+	return addrPart, true
+}
+
 type RedisInterface interface {
 	GetKey() string
 }
@@ -73,11 +450,12 @@ func RedisSaveWithConn(r redis.Conn, v interface{}) (err error) {
 	case RedisStorer:
 		err = s.RedisSave(r)
 	case RedisInterface:
-		data, err := GobEncode(s)
+		var data []byte
+		data, err = codec.Encode(s)
 		if err != nil {
 			return err
 		}
-		_, err = r.Do("SET", s.GetKey(), data)
+		_, err = doCmd(r, "SET", s.GetKey(), data)
 	default:
 		err = fmt.Errorf("Unsupperted Type!")
 	}
@@ -95,11 +473,12 @@ func RedisLoadWithConn(r redis.Conn, v interface{}) (err error) {
 	case RedisLoader:
 		err = l.RedisLoad(r)
 	case RedisInterface:
-		data, err := redis.Bytes(r.Do("GET", l.GetKey()))
+		var data []byte
+		data, err = redis.Bytes(doCmd(r, "GET", l.GetKey()))
 		if err != nil {
 			return err
 		}
-		err = GobDecode(data, l)
+		err = codec.Decode(data, l)
 	default:
 		err = fmt.Errorf("Unsupperted Type!")
 	}
@@ -117,7 +496,108 @@ func RedisRemoveWithConn(r redis.Conn, v interface{}) (err error) {
 	case RedisRemover:
 		err = rm.RedisRemove(r)
 	case RedisInterface:
-		_, err = r.Do("DEL", rm.GetKey())
+		_, err = doCmd(r, "DEL", rm.GetKey())
+	default:
+		err = fmt.Errorf("Unsupported Type!")
+	}
+	return
+}
+
+// RedisStorerContext is the context-aware counterpart of RedisStorer.
+type RedisStorerContext interface {
+	RedisSaveContext(ctx context.Context, r redis.Conn) error
+}
+
+// RedisLoaderContext is the context-aware counterpart of RedisLoader.
+type RedisLoaderContext interface {
+	RedisLoadContext(ctx context.Context, r redis.Conn) error
+}
+
+// doContext runs cmd on r honoring ctx: it fails fast if ctx is already
+// done, and otherwise bounds the call with redis.DoWithTimeout using
+// ctx's deadline (if any), so a slow Redis can't hang the caller's
+// goroutine past what ctx allows.
+func doContext(ctx context.Context, r redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var reply interface{}
+	var err error
+	if deadline, ok := ctx.Deadline(); ok {
+		reply, err = redis.DoWithTimeout(r, time.Until(deadline), cmd, args...)
+	} else {
+		reply, err = r.Do(cmd, args...)
+	}
+	metrics.OnCommand(cmd, args, time.Since(start), err)
+	if err != nil {
+		logger.Printf("common: %s %v: %v", cmd, args, err)
+	}
+	return reply, err
+}
+
+func RedisSaveContext(ctx context.Context, v interface{}) error {
+	r := pool.Get()
+	defer r.Close()
+	return RedisSaveWithConnContext(ctx, r, v)
+}
+
+func RedisSaveWithConnContext(ctx context.Context, r redis.Conn, v interface{}) (err error) {
+	switch s := v.(type) {
+	case RedisStorerContext:
+		err = s.RedisSaveContext(ctx, r)
+	case RedisStorer:
+		err = s.RedisSave(r)
+	case RedisInterface:
+		var data []byte
+		data, err = codec.Encode(s)
+		if err != nil {
+			return err
+		}
+		_, err = doContext(ctx, r, "SET", s.GetKey(), data)
+	default:
+		err = fmt.Errorf("Unsupperted Type!")
+	}
+	return
+}
+
+func RedisLoadContext(ctx context.Context, v interface{}) error {
+	r := pool.Get()
+	defer r.Close()
+	return RedisLoadWithConnContext(ctx, r, v)
+}
+
+func RedisLoadWithConnContext(ctx context.Context, r redis.Conn, v interface{}) (err error) {
+	switch l := v.(type) {
+	case RedisLoaderContext:
+		err = l.RedisLoadContext(ctx, r)
+	case RedisLoader:
+		err = l.RedisLoad(r)
+	case RedisInterface:
+		var data []byte
+		data, err = redis.Bytes(doContext(ctx, r, "GET", l.GetKey()))
+		if err != nil {
+			return err
+		}
+		err = codec.Decode(data, l)
+	default:
+		err = fmt.Errorf("Unsupperted Type!")
+	}
+	return
+}
+
+func RedisRemoveContext(ctx context.Context, v interface{}) error {
+	r := pool.Get()
+	defer r.Close()
+	return RedisRemoveWithConnContext(ctx, r, v)
+}
+
+func RedisRemoveWithConnContext(ctx context.Context, r redis.Conn, v interface{}) (err error) {
+	switch rm := v.(type) {
+	case RedisRemover:
+		err = rm.RedisRemove(r)
+	case RedisInterface:
+		_, err = doContext(ctx, r, "DEL", rm.GetKey())
 	default:
 		err = fmt.Errorf("Unsupported Type!")
 	}
@@ -182,12 +662,14 @@ func (v *RedisSlice) RedisSave(r redis.Conn) error {
 		switch ro := v.slice.Index(i).Interface().(type) {
 		case RedisInterface:
 			keys[i+1] = ro.GetKey()
-			RedisSaveWithConn(r, ro)
+			if err := RedisSaveWithConn(r, ro); err != nil {
+				return err
+			}
 		default:
 			keys[i+1] = ro
 		}
 	}
-	_, err := r.Do("SADD", keys...)
+	_, err := doCmd(r, "SADD", keys...)
 	return err
 }
 
@@ -195,7 +677,7 @@ func (v *RedisSlice) RedisLoad(r redis.Conn) error {
 	elemType := reflect.Indirect(reflect.New(v.eType))
 	switch elemType.Interface().(type) {
 	case RedisInterface:
-		reply, err := redis.Values(r.Do("SORT", v.key, "GET", "*"))
+		reply, err := redis.Values(doCmd(r, "SORT", v.key, "GET", "*"))
 		if err != nil {
 			return err
 		}
@@ -204,9 +686,9 @@ func (v *RedisSlice) RedisLoad(r redis.Conn) error {
 			elem := reflect.New(v.eType.Elem())
 			data, err := redis.Bytes(data, nil)
 			if err != nil {
-				return nil
+				return err
 			}
-			err = GobDecode(data, elem.Interface())
+			err = codec.Decode(data, elem.Interface())
 			if err != nil {
 				return err
 			}
@@ -214,7 +696,7 @@ func (v *RedisSlice) RedisLoad(r redis.Conn) error {
 		}
 		v.slice.Set(newVal)
 	default:
-		reply, err := redis.Values(r.Do("SMEMBERS", v.key))
+		reply, err := redis.Values(doCmd(r, "SMEMBERS", v.key))
 		if err != nil {
 			return err
 		}
@@ -249,59 +731,434 @@ func (v *RedisSlice) RedisRemove(r redis.Conn) error {
 		switch ro := v.slice.Index(i).Interface().(type) {
 		case RedisInterface:
 			keys[i+1] = ro.GetKey()
-			RedisRemoveWithConn(r, ro)
+			if err := RedisRemoveWithConn(r, ro); err != nil {
+				return err
+			}
 		default:
 			keys[i+1] = ro
 		}
 	}
-	_, err := r.Do("SREM", keys...)
+	_, err := doCmd(r, "SREM", keys...)
+	return err
+}
+
+// RedisZScorer is implemented by elements stored in a RedisZSet. ZScore
+// provides the sort key for the underlying Redis sorted set, e.g. an IRC
+// log id or a unix timestamp, so that RedisZSet.RedisLoad and
+// RangeByScore can page through elements in that order.
+type RedisZScorer interface {
+	ZScore() int64
+}
+
+// RedisZSet is a sorted-set backed counterpart of RedisSlice. Unlike
+// RedisSlice, which SADDs element keys and stores each element under its
+// own key, RedisZSet ZADDs the element itself, encoded with the current
+// Codec, as the member, scored by RedisZScorer.ZScore(). This suits time-ordered data such as
+// IRC channel logs, where callers want a paginated, ordered read instead
+// of an O(N) SMEMBERS + SORT round trip.
+type RedisZSet struct {
+	key   string
+	slice reflect.Value
+	sType reflect.Type
+	eType reflect.Type
+}
+
+func MakeRedisZSet(key string, slicePtr interface{}) (*RedisZSet, error) {
+	val := reflect.ValueOf(slicePtr)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("MakeRedisZSet: Must be slice pointer type")
+	}
+	return &RedisZSet{
+		key:   key,
+		slice: reflect.Indirect(val),
+		sType: val.Elem().Type(),
+		eType: val.Elem().Type().Elem(),
+	}, nil
+}
+
+func RedisZSetSave(key string, slicePtr interface{}) error {
+	rz, err := MakeRedisZSet(key, slicePtr)
+	if err != nil {
+		return err
+	}
+	return RedisSave(rz)
+}
+
+func RedisZSetLoad(key string, slicePtr interface{}) error {
+	rz, err := MakeRedisZSet(key, slicePtr)
+	if err != nil {
+		return err
+	}
+	return RedisLoad(rz)
+}
+
+func RedisZSetRemove(key string, slicePtr interface{}) error {
+	rz, err := MakeRedisZSet(key, slicePtr)
+	if err != nil {
+		return err
+	}
+	return RedisRemove(rz)
+}
+
+func (v *RedisZSet) RedisSave(r redis.Conn) error {
+	if v.slice.Len() == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, 1, 1+2*v.slice.Len())
+	args[0] = v.key
+	for i := 0; i < v.slice.Len(); i++ {
+		elem := v.slice.Index(i).Interface()
+		scorer, ok := elem.(RedisZScorer)
+		if !ok {
+			return fmt.Errorf("RedisZSet: element %T does not implement RedisZScorer", elem)
+		}
+		data, err := codec.Encode(elem)
+		if err != nil {
+			return err
+		}
+		args = append(args, scorer.ZScore(), data)
+	}
+	_, err := doCmd(r, "ZADD", args...)
 	return err
 }
 
+// redisZSetLoadPageSize bounds how many members RedisLoad fetches per
+// ZREVRANGEBYSCORE round trip, so loading a large set still happens in
+// pages instead of one unbounded reply.
+const redisZSetLoadPageSize = 1000
+
+// zsetPageCursor tracks RedisLoad's position when paging a RedisZSet whose
+// scores aren't guaranteed unique (e.g. a coarse unix-timestamp score).
+// Excluding the last-seen score with "(score" on every page would silently
+// drop any tied member past the first one that crosses a page boundary, so
+// the cursor instead stays on the boundary score and advances an offset
+// past however many tied members have already been fetched.
+type zsetPageCursor struct {
+	max    string
+	offset int
+	last   int64
+	have   bool
+	tied   int
+}
+
+func newZSetPageCursor() *zsetPageCursor {
+	return &zsetPageCursor{max: "+inf"}
+}
+
+// advance folds in one page's scores, most-recent-first, and returns the
+// max/offset ZREVRANGEBYSCORE should use to fetch the next page.
+func (c *zsetPageCursor) advance(scores []int64) (max string, offset int) {
+	for _, score := range scores {
+		if c.have && score == c.last {
+			c.tied++
+		} else {
+			c.tied = 1
+		}
+		c.last = score
+		c.have = true
+	}
+	c.max = fmt.Sprintf("%d", c.last)
+	c.offset = c.tied
+	return c.max, c.offset
+}
+
+// RedisLoad reads every member of the set, most-recent first, paging
+// internally via ZREVRANGEBYSCORE ... LIMIT so no single round trip has
+// to return the whole set at once. It still loads the set in full: for
+// caller-controlled pagination (e.g. "give me the last 50"), use
+// RangeByScore instead.
+func (v *RedisZSet) RedisLoad(r redis.Conn) error {
+	result := reflect.MakeSlice(v.sType, 0, 0)
+	cursor := newZSetPageCursor()
+	max, offset := cursor.max, cursor.offset
+	for {
+		reply, err := redis.Values(doCmd(r, "ZREVRANGEBYSCORE", v.key, max, "-inf", "LIMIT", offset, redisZSetLoadPageSize))
+		if err != nil {
+			return err
+		}
+		if len(reply) == 0 {
+			break
+		}
+		page, err := v.decodeElems(reply)
+		if err != nil {
+			return err
+		}
+		result = reflect.AppendSlice(result, page)
+		if len(reply) < redisZSetLoadPageSize {
+			break
+		}
+		scores := make([]int64, page.Len())
+		for i := 0; i < page.Len(); i++ {
+			scores[i] = page.Index(i).Interface().(RedisZScorer).ZScore()
+		}
+		max, offset = cursor.advance(scores)
+	}
+	v.slice.Set(result)
+	return nil
+}
+
+func (v *RedisZSet) RedisRemove(r redis.Conn) error {
+	_, err := doCmd(r, "DEL", v.key)
+	return err
+}
+
+// RangeByScore fetches up to limit elements with score in [min, max],
+// ordered from max to min, via ZREVRANGEBYSCORE ... LIMIT 0 limit.
+func (v *RedisZSet) RangeByScore(r redis.Conn, min, max int64, limit int) error {
+	reply, err := redis.Values(doCmd(r, "ZREVRANGEBYSCORE", v.key, max, min, "LIMIT", 0, limit))
+	if err != nil {
+		return err
+	}
+	return v.setFromReply(reply)
+}
+
+// Trim caps the sorted set at maxLen elements by dropping the
+// lowest-scored members via ZREMRANGEBYRANK, without loading them.
+func (v *RedisZSet) Trim(r redis.Conn, maxLen int) error {
+	_, err := doCmd(r, "ZREMRANGEBYRANK", v.key, 0, -maxLen-1)
+	return err
+}
+
+func (v *RedisZSet) setFromReply(reply []interface{}) error {
+	newVal, err := v.decodeElems(reply)
+	if err != nil {
+		return err
+	}
+	v.slice.Set(newVal)
+	return nil
+}
+
+func (v *RedisZSet) decodeElems(reply []interface{}) (reflect.Value, error) {
+	newVal := reflect.MakeSlice(v.sType, len(reply), len(reply))
+	for i, raw := range reply {
+		data, err := redis.Bytes(raw, nil)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		elem := reflect.New(v.eType.Elem())
+		if err := codec.Decode(data, elem.Interface()); err != nil {
+			return reflect.Value{}, err
+		}
+		newVal.Index(i).Set(elem)
+	}
+	return newVal, nil
+}
+
 type RedisNumber struct {
 	Key string
 }
 
+// Get returns the counter's current value, logging and returning 0 if
+// the GET fails. Prefer GetContext, which reports the error instead of
+// swallowing it.
 func (v *RedisNumber) Get() int64 {
+	n, err := v.GetContext(context.Background())
+	if err != nil {
+		logger.Printf("common: RedisNumber.Get: %v", err)
+		return 0
+	}
+	return n
+}
+
+// GetContext returns the counter's current value, or an error if ctx is
+// canceled/expires or the GET itself fails or returns something that
+// isn't an integer. A missing key is not an error: it returns 0, nil.
+func (v *RedisNumber) GetContext(ctx context.Context) (int64, error) {
 	r := pool.Get()
 	defer r.Close()
 
-	reply, err := r.Do("GET", v.Key)
+	reply, err := doContext(ctx, r, "GET", v.Key)
 	if err != nil {
-		fmt.Println("RedisNumber: Get Error", err)
-		return 0
+		return 0, fmt.Errorf("RedisNumber: Get %s: %v", v.Key, err)
 	}
-	switch reply := reply.(type) {
-	case int64:
-		return reply
-	case []byte:
-		n, _ := strconv.ParseInt(string(reply), 10, 64)
-		return n
-	default:
-		fmt.Println("RedisNumber: Get Error", reply)
+	return parseRedisNumberReply(reply)
+}
+
+// Incr atomically increments the counter and returns its new value,
+// logging and returning 0 if the INCR fails. Prefer IncrContext, which
+// reports the error instead of swallowing it.
+func (v *RedisNumber) Incr() int64 {
+	n, err := v.IncrContext(context.Background())
+	if err != nil {
+		logger.Printf("common: RedisNumber.Incr: %v", err)
 		return 0
 	}
-	return 0
+	return n
 }
 
-func (v *RedisNumber) Incr() int64 {
+// IncrContext atomically increments the counter and returns its new
+// value, or an error if ctx is canceled/expires or the INCR itself fails.
+func (v *RedisNumber) IncrContext(ctx context.Context) (int64, error) {
 	r := pool.Get()
 	defer r.Close()
 
-	reply, err := r.Do("INCR", v.Key)
+	reply, err := doContext(ctx, r, "INCR", v.Key)
 	if err != nil {
-		fmt.Println("RedisNumber: Incr Error", err)
-		return 0
+		return 0, fmt.Errorf("RedisNumber: Incr %s: %v", v.Key, err)
 	}
+	return parseRedisNumberReply(reply)
+}
+
+func parseRedisNumberReply(reply interface{}) (int64, error) {
 	switch reply := reply.(type) {
+	case nil:
+		return 0, nil
 	case int64:
-		return reply
+		return reply, nil
 	case []byte:
-		n, _ := strconv.ParseInt(string(reply), 10, 64)
-		return n
+		return strconv.ParseInt(string(reply), 10, 64)
 	default:
-		fmt.Println("RedisNumber: Incr Error", reply)
-		return 0
+		return 0, fmt.Errorf("RedisNumber: unexpected reply %v", reply)
+	}
+}
+
+// Batch buffers Save/Remove/Incr operations and flushes them against a
+// single pooled connection inside a MULTI/EXEC transaction, so a write
+// like "save every IRCLog in a channel restore, then update its
+// membership set" costs one round trip and one atomic commit instead of
+// N+1 synchronous calls.
+//
+//	err := common.NewBatch().SaveAll(&logs).AddToSet(key, &logs).Commit()
+type Batch struct {
+	conn redis.Conn
+	err  error
+}
+
+// sendCmd queues cmd on conn via Send, reporting it through the same
+// Logger/Metrics hooks as doCmd. Send doesn't wait for a reply, so the
+// reported duration is always zero; the command's real latency is
+// attributed to the EXEC that Commit issues to flush the whole batch.
+func sendCmd(conn redis.Conn, cmd string, args ...interface{}) error {
+	err := conn.Send(cmd, args...)
+	metrics.OnCommand(cmd, args, 0, err)
+	if err != nil {
+		logger.Printf("common: %s %v: %v", cmd, args, err)
+	}
+	return err
+}
+
+// NewBatch checks out a connection from the default pool and opens a
+// MULTI transaction on it. The connection is held until Commit closes it.
+func NewBatch() *Batch {
+	b := &Batch{conn: pool.Get()}
+	b.err = sendCmd(b.conn, "MULTI")
+	return b
+}
+
+// SaveAll queues a SET for every element of the slice pointed to by
+// slicePtr, each element encoded with the current Codec under its own
+// RedisInterface key.
+func (b *Batch) SaveAll(slicePtr interface{}) *Batch {
+	if b.err != nil {
+		return b
+	}
+	slice, err := batchSlice(slicePtr)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	for i := 0; i < slice.Len(); i++ {
+		ro, ok := slice.Index(i).Interface().(RedisInterface)
+		if !ok {
+			b.err = fmt.Errorf("Batch: SaveAll: element %T does not implement RedisInterface", slice.Index(i).Interface())
+			return b
+		}
+		data, err := codec.Encode(ro)
+		if err != nil {
+			b.err = err
+			return b
+		}
+		if b.err = sendCmd(b.conn, "SET", ro.GetKey(), data); b.err != nil {
+			return b
+		}
+	}
+	return b
+}
+
+// AddToSet queues a single SADD that adds every element of the slice
+// pointed to by slicePtr to the set at key, mirroring RedisSlice.RedisSave.
+func (b *Batch) AddToSet(key string, slicePtr interface{}) *Batch {
+	if b.err != nil {
+		return b
+	}
+	slice, err := batchSlice(slicePtr)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	if slice.Len() == 0 {
+		return b
+	}
+	members := make([]interface{}, slice.Len()+1)
+	members[0] = key
+	for i := 0; i < slice.Len(); i++ {
+		switch ro := slice.Index(i).Interface().(type) {
+		case RedisInterface:
+			members[i+1] = ro.GetKey()
+		default:
+			members[i+1] = ro
+		}
+	}
+	b.err = sendCmd(b.conn, "SADD", members...)
+	return b
+}
+
+// Remove queues a DEL for v's RedisInterface key.
+func (b *Batch) Remove(v interface{}) *Batch {
+	if b.err != nil {
+		return b
+	}
+	ro, ok := v.(RedisInterface)
+	if !ok {
+		b.err = fmt.Errorf("Batch: Remove: %T does not implement RedisInterface", v)
+		return b
+	}
+	b.err = sendCmd(b.conn, "DEL", ro.GetKey())
+	return b
+}
+
+// Incr queues an INCR of key. Its result is discarded by Commit; use
+// RedisNumber.Incr directly if the incremented value is needed.
+func (b *Batch) Incr(key string) *Batch {
+	if b.err != nil {
+		return b
+	}
+	b.err = sendCmd(b.conn, "INCR", key)
+	return b
+}
+
+// Commit flushes the queued commands as a single MULTI/EXEC round trip
+// and closes the underlying connection. If any queue step failed, the
+// transaction is discarded and that step's error is returned. EXEC itself
+// succeeding only means the transaction ran: a queued command can still
+// fail (e.g. INCR on a non-numeric key) and report that failure as a
+// redis.Error inside EXEC's reply array rather than as a returned error,
+// so Commit also walks that array for an embedded error before declaring
+// success.
+func (b *Batch) Commit() error {
+	defer b.conn.Close()
+	if b.err != nil {
+		sendCmd(b.conn, "DISCARD")
+		b.conn.Flush()
+		return b.err
+	}
+	reply, err := redis.Values(doCmd(b.conn, "EXEC"))
+	if err != nil {
+		return err
+	}
+	for i, r := range reply {
+		if e, ok := r.(redis.Error); ok {
+			return fmt.Errorf("Batch: queued command %d failed: %v", i, e)
+		}
+	}
+	return nil
+}
+
+func batchSlice(slicePtr interface{}) (reflect.Value, error) {
+	val := reflect.ValueOf(slicePtr)
+	if val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Slice {
+		return reflect.Value{}, fmt.Errorf("Batch: Must be slice pointer type")
 	}
-	return 0
+	return reflect.Indirect(val), nil
 }
@@ -0,0 +1,211 @@
+package common
+
+import (
+	"redigo/redis"
+	"testing"
+)
+
+func TestParseRedirect(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want redisRedirect
+		ok   bool
+	}{
+		{"moved", redis.Error("MOVED 3999 127.0.0.1:7001"), redisRedirect{kind: "MOVED", addr: "127.0.0.1:7001"}, true},
+		{"ask", redis.Error("ASK 3999 127.0.0.1:7002"), redisRedirect{kind: "ASK", addr: "127.0.0.1:7002"}, true},
+		{"readonly", redis.Error("READONLY You can't write against a read only replica."), redisRedirect{kind: "READONLY"}, true},
+		{"other redis error", redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), redisRedirect{}, false},
+		{"non redis error", errNotRedis, redisRedirect{}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := parseRedirect(c.err)
+			if ok != c.ok || got != c.want {
+				t.Errorf("parseRedirect(%q) = %+v, %v; want %+v, %v", c.err, got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
+
+func TestParseRedirectAddr(t *testing.T) {
+	cases := []struct {
+		msg      string
+		wantAddr string
+		wantOk   bool
+	}{
+		{"MOVED 3999 127.0.0.1:7001", "127.0.0.1:7001", true},
+		{"ASK 3999 10.0.0.5:6380", "10.0.0.5:6380", true},
+		{"MOVED not-enough-fields", "", false},
+	}
+	for _, c := range cases {
+		addr, ok := parseRedirectAddr(c.msg)
+		if addr != c.wantAddr || ok != c.wantOk {
+			t.Errorf("parseRedirectAddr(%q) = %q, %v; want %q, %v", c.msg, addr, ok, c.wantAddr, c.wantOk)
+		}
+	}
+}
+
+type plainError string
+
+func (e plainError) Error() string { return string(e) }
+
+const errNotRedis = plainError("dial tcp: connection refused")
+
+func TestZSetPageCursor(t *testing.T) {
+	c := newZSetPageCursor()
+	if c.max != "+inf" || c.offset != 0 {
+		t.Fatalf("newZSetPageCursor() = %q, %d; want +inf, 0", c.max, c.offset)
+	}
+
+	// First page ends with three members tied on score 10: the cursor must
+	// stay on 10 and skip exactly those three on the next page, not exclude
+	// score 10 entirely via "(10".
+	max, offset := c.advance([]int64{30, 20, 10, 10, 10})
+	if max != "10" || offset != 3 {
+		t.Fatalf("advance() = %q, %d; want 10, 3", max, offset)
+	}
+
+	// Second page starts with two more members still at score 10, then
+	// drops to 5: the cursor moves to the new boundary score and the offset
+	// restarts at the one member seen there.
+	max, offset = c.advance([]int64{10, 10, 5})
+	if max != "5" || offset != 1 {
+		t.Fatalf("advance() = %q, %d; want 5, 1", max, offset)
+	}
+}
+
+func TestParseRedisNumberReply(t *testing.T) {
+	cases := []struct {
+		name    string
+		reply   interface{}
+		want    int64
+		wantErr bool
+	}{
+		{"nil reply treated as zero", nil, 0, false},
+		{"int64 reply", int64(42), 42, false},
+		{"bulk string reply", []byte("42"), 42, false},
+		{"unparseable bulk string", []byte("nope"), 0, true},
+		{"unexpected type", "42", 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := parseRedisNumberReply(c.reply)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("parseRedisNumberReply(%v) error = %v, wantErr %v", c.reply, err, c.wantErr)
+			}
+			if !c.wantErr && got != c.want {
+				t.Errorf("parseRedisNumberReply(%v) = %d, want %d", c.reply, got, c.want)
+			}
+		})
+	}
+}
+
+// fakeConn is a minimal redis.Conn that records the last Do call, for
+// tests that only care what command RedisZSet issues.
+type fakeConn struct {
+	redis.Conn
+	lastCmd  string
+	lastArgs []interface{}
+	do       func(cmd string, args ...interface{}) (interface{}, error)
+}
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.lastCmd, c.lastArgs = cmd, args
+	if c.do != nil {
+		return c.do(cmd, args...)
+	}
+	return nil, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Err() error   { return nil }
+
+// scriptedConn is a redis.Conn double for Batch tests: Send just records
+// the command name, and Do returns whatever reply/err is scripted.
+type scriptedConn struct {
+	sent    []string
+	doReply interface{}
+	doErr   error
+}
+
+func (c *scriptedConn) Send(cmd string, args ...interface{}) error {
+	c.sent = append(c.sent, cmd)
+	return nil
+}
+func (c *scriptedConn) Flush() error                  { return nil }
+func (c *scriptedConn) Receive() (interface{}, error) { return nil, nil }
+func (c *scriptedConn) Close() error                  { return nil }
+func (c *scriptedConn) Err() error                    { return nil }
+func (c *scriptedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.sent = append(c.sent, cmd)
+	return c.doReply, c.doErr
+}
+
+func TestBatchErrShortCircuitsQueueing(t *testing.T) {
+	fc := &scriptedConn{}
+	b := &Batch{conn: fc}
+	b.err = plainError("earlier queue step failed")
+
+	b.Incr("counter").Remove(&RedisObject{Key: "k"})
+
+	if len(fc.sent) != 0 {
+		t.Errorf("queue methods sent %v after b.err was already set, want none", fc.sent)
+	}
+
+	fc.doReply = "EXEC-should-not-run"
+	if err := b.Commit(); err == nil {
+		t.Fatal("Commit() = nil, want the earlier queue error")
+	}
+	if fc.sent[len(fc.sent)-1] != "DISCARD" {
+		t.Errorf("Commit() with a pending b.err sent %v, want it to end in DISCARD", fc.sent)
+	}
+}
+
+func TestBatchCommitChecksExecReplyForEmbeddedErrors(t *testing.T) {
+	fc := &scriptedConn{doReply: []interface{}{
+		"OK",
+		redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"),
+	}}
+	b := &Batch{conn: fc}
+
+	if err := b.Commit(); err == nil {
+		t.Fatal("Commit() = nil despite an embedded redis.Error in the EXEC reply")
+	}
+}
+
+func TestBatchCommitSucceedsOnCleanExecReply(t *testing.T) {
+	fc := &scriptedConn{doReply: []interface{}{"OK", int64(1)}}
+	b := &Batch{conn: fc}
+
+	if err := b.Commit(); err != nil {
+		t.Fatalf("Commit() = %v, want nil", err)
+	}
+}
+
+func TestRedisZSetTrimRankArithmetic(t *testing.T) {
+	cases := []struct {
+		maxLen   int
+		wantRank int
+	}{
+		{1, -2},
+		{50, -51},
+		{1000, -1001},
+	}
+	for _, c := range cases {
+		fc := &fakeConn{}
+		z, err := MakeRedisZSet("chan:1:log", &[]*struct{}{})
+		if err != nil {
+			t.Fatalf("MakeRedisZSet: %v", err)
+		}
+		if err := z.Trim(fc, c.maxLen); err != nil {
+			t.Fatalf("Trim(%d): %v", c.maxLen, err)
+		}
+		if fc.lastCmd != "ZREMRANGEBYRANK" {
+			t.Fatalf("Trim(%d) issued %q, want ZREMRANGEBYRANK", c.maxLen, fc.lastCmd)
+		}
+		if len(fc.lastArgs) != 3 || fc.lastArgs[1] != 0 || fc.lastArgs[2] != c.wantRank {
+			t.Errorf("Trim(%d) args = %v, want [key 0 %d]", c.maxLen, fc.lastArgs, c.wantRank)
+		}
+	}
+}